@@ -3,9 +3,10 @@ package fs
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"io/ioutil"
+	"io"
 	"os"
 	"path"
+	"runtime"
 
 	"github.com/pkg/errors"
 )
@@ -49,23 +50,113 @@ func EnsureDirectoryExists(path string) error {
 // Save the filecontents at the specified path atomically:
 // - first save the content in a temp file with a random filename in the same dir
 // - then rename the temp file to the specified filepath, overwriting the old file
-func SaveFile(filepath string, content []byte) (err error) {
+//
+// The temp file is fsynced before the rename, so its contents cannot be lost,
+// but the containing directory is not synced: a crash right after SaveFile
+// returns may still leave the rename itself unobserved. Use SaveFileSync or
+// SaveFileAtomic when that additional guarantee is needed.
+func SaveFile(filepath string, content []byte) error {
+	return saveFileAtomic(filepath, false, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// SaveFileSync behaves like SaveFile, additionally fsyncing the directory
+// containing filepath after the rename, so that a crash cannot leave the
+// directory entry for filepath unobserved.
+func SaveFileSync(filepath string, content []byte) error {
+	return saveFileAtomic(filepath, true, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// SaveFileAtomic atomically saves the data written by write at filepath, with
+// the same durability guarantees as SaveFileSync. Unlike SaveFileSync, it
+// streams write's output straight into the temp file instead of requiring the
+// full contents in memory beforehand, so it is the better choice for large
+// blobs such as credential or log databases.
+func SaveFileAtomic(filepath string, write func(io.Writer) error) error {
+	return saveFileAtomic(filepath, true, write)
+}
+
+// saveFileAtomic is the shared implementation behind SaveFile, SaveFileSync
+// and SaveFileAtomic: it writes write's output to a temp file in the same
+// directory as filepath, fsyncs it, and renames it over filepath. If syncDir
+// is set, it additionally fsyncs the containing directory afterwards.
+func saveFileAtomic(filepath string, syncDir bool, write func(io.Writer) error) error {
 	dir := path.Dir(filepath)
 
+	tempfilename, err := writeTempFile(dir, write)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tempfilename, filepath); err != nil {
+		return err
+	}
+
+	if syncDir {
+		return syncDirectory(dir)
+	}
+	return nil
+}
+
+// writeTempFile writes write's output to a new, fsynced file with a random
+// name in dir, and returns its path. On any failure the temp file is removed
+// before returning.
+func writeTempFile(dir string, write func(io.Writer) error) (string, error) {
 	// Read random data for filename and convert to hex
 	randBytes := make([]byte, 16)
-	_, err = rand.Read(randBytes)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	tempfilename := path.Join(dir, hex.EncodeToString(randBytes))
+
+	f, err := os.OpenFile(tempfilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return
+		return "", err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			_ = f.Close()
+			_ = os.Remove(tempfilename)
+		}
+	}()
+
+	if err := write(f); err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	ok = true
+	return tempfilename, nil
+}
+
+// syncDirectory fsyncs dir, so that a rename into it cannot be lost to a
+// crash even though it is already visible. This is a no-op on Windows, whose
+// filesystems do not support opening a directory for syncing.
+func syncDirectory(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
 	}
-	tempfilename := hex.EncodeToString(randBytes)
 
-	// Create temp file
-	err = ioutil.WriteFile(dir+"/"+tempfilename, content, 0600)
+	d, err := os.Open(dir)
 	if err != nil {
-		return
+		return err
 	}
+	defer func() {
+		_ = d.Close()
+	}()
 
-	// Rename, overwriting old file
-	return os.Rename(dir+"/"+tempfilename, filepath)
-}
\ No newline at end of file
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync directory "+dir)
+	}
+	return nil
+}
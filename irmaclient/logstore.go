@@ -0,0 +1,359 @@
+package irmaclient
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	logBucket       = []byte("logs")       // encrypted LogEntry bodies, keyed by an 8-byte big-endian sequence number
+	logHeaderBucket = []byte("logHeaders") // unencrypted LogHeader records, keyed the same as logBucket
+
+	errLogEntryCorrupted = errors.New("log entry ciphertext is corrupted or truncated")
+)
+
+// LogHeader is the small amount of per-entry metadata that LogStore keeps
+// unencrypted next to the encrypted LogEntry, so that Query can filter log
+// entries by session type, credential type or time without decrypting
+// every record.
+type LogHeader struct {
+	Type            irma.Action
+	Time            irma.Timestamp
+	Version         *irma.ProtocolVersion           `json:",omitempty"`
+	CredentialTypes []irma.CredentialTypeIdentifier `json:",omitempty"`
+}
+
+// LogFilter restricts a LogStore.Query to log entries matching all of its
+// non-nil fields.
+type LogFilter struct {
+	Type           *irma.Action
+	CredentialType *irma.CredentialTypeIdentifier
+	From, To       *irma.Timestamp
+}
+
+func (f LogFilter) matches(h LogHeader) bool {
+	if f.Type != nil && h.Type != *f.Type {
+		return false
+	}
+	if f.From != nil && time.Time(h.Time).Before(time.Time(*f.From)) {
+		return false
+	}
+	if f.To != nil && time.Time(h.Time).After(time.Time(*f.To)) {
+		return false
+	}
+	if f.CredentialType != nil {
+		found := false
+		for _, ct := range h.CredentialTypes {
+			if ct == *f.CredentialType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// LogStore is an encrypted-at-rest store of LogEntry records, backed by the
+// same bbolt database file as the rest of the client's storage. The full
+// contents of each entry (which may include disclosed attribute values) are
+// encrypted with an AEAD cipher; only its LogHeader is kept in the clear.
+//
+// Nothing in this tree yet replaces the log persistence that actually runs:
+// irmaclient/storage.go, which would own that, does not exist in this
+// snapshot, so no log entry written by a running client goes through
+// LogStore yet. Wiring it in (constructing it alongside the rest of the
+// client's storage and calling Append from session.createLogEntry) is a
+// required follow-up, not done here.
+type LogStore struct {
+	db   *bolt.DB
+	aead cipher.AEAD
+}
+
+// deriveLogKey derives the AEAD key used by a LogStore from the
+// keyshare/PIN-protected storage key, via HKDF-SHA256.
+func deriveLogKey(storageKey []byte) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	kdf := hkdf.New(sha256.New, storageKey, nil, []byte("irmaclient.LogStore"))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewLogStore opens (creating if necessary) the log buckets in db, deriving
+// its encryption key from storageKey using HKDF-SHA256. If db still
+// contains entries written by a version of this client that stored them as
+// plaintext JSON, those entries are encrypted in place before NewLogStore
+// returns.
+func NewLogStore(db *bolt.DB, storageKey []byte) (*LogStore, error) {
+	key, err := deriveLogKey(storageKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &LogStore{db: db, aead: aead}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(logBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(logHeaderBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.migratePlaintextEntries(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Append encrypts entry and appends it to the store. credentialTypes is the
+// set of credential types involved in the session the entry records (if
+// any); it is stored unencrypted in the entry's LogHeader so that Query can
+// filter on it.
+func (s *LogStore) Append(entry *LogEntry, credentialTypes []irma.CredentialTypeIdentifier) error {
+	header, ciphertext, err := s.seal(entry, credentialTypes)
+	if err != nil {
+		return err
+	}
+	headerBts, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := sequenceKey(seq)
+		if err := bucket.Put(key, ciphertext); err != nil {
+			return err
+		}
+		return tx.Bucket(logHeaderBucket).Put(key, headerBts)
+	})
+}
+
+// Query returns log entries matching filter, newest first, skipping the
+// first offset matches and returning at most limit of them (or all
+// remaining matches if limit is negative).
+func (s *LogStore) Query(filter LogFilter, offset, limit int) ([]*LogEntry, error) {
+	var matchedKeys [][]byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(logHeaderBucket).Cursor()
+		// Keys are big-endian sequence numbers, so bbolt's ascending
+		// iteration order is chronological; walking from Last() to First()
+		// therefore visits entries newest-first.
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var header LogHeader
+			if err := json.Unmarshal(v, &header); err != nil {
+				return err
+			}
+			if filter.matches(header) {
+				matchedKeys = append(matchedKeys, append([]byte{}, k...))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > len(matchedKeys) {
+		offset = len(matchedKeys)
+	}
+	matchedKeys = matchedKeys[offset:]
+	if limit >= 0 && limit < len(matchedKeys) {
+		matchedKeys = matchedKeys[:limit]
+	}
+
+	entries := make([]*LogEntry, 0, len(matchedKeys))
+	err = s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logBucket)
+		for _, k := range matchedKeys {
+			entry, err := s.open(bucket.Get(k))
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Rotate re-encrypts every stored log entry with the key derived from
+// newStorageKey, and switches the store over to using it. Call this
+// whenever the underlying keyshare/PIN-protected storage key changes.
+func (s *LogStore) Rotate(newStorageKey []byte) error {
+	newKey, err := deriveLogKey(newStorageKey)
+	if err != nil {
+		return err
+	}
+	newAead, err := chacha20poly1305.New(newKey)
+	if err != nil {
+		return err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logBucket)
+
+		var keys [][]byte
+		var entries []*LogEntry
+		err := bucket.ForEach(func(k, v []byte) error {
+			entry, err := s.open(v)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte{}, k...))
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for i, k := range keys {
+			ciphertext, err := sealWith(newAead, entries[i])
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(k, ciphertext); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.aead = newAead
+	return nil
+}
+
+// migratePlaintextEntries re-encrypts any entries still stored in the
+// legacy plaintext format: a valid LogEntry can be json.Unmarshal'd
+// directly from such a record, whereas an encrypted one is random-looking
+// ciphertext that will fail to unmarshal as JSON.
+func (s *LogStore) migratePlaintextEntries() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logBucket)
+		headers := tx.Bucket(logHeaderBucket)
+
+		type legacyEntry struct {
+			key   []byte
+			entry *LogEntry
+		}
+		var toMigrate []legacyEntry
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			if headers.Get(k) != nil {
+				return nil // already has a header: already migrated
+			}
+			var entry LogEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return nil // not legacy plaintext JSON; leave it alone
+			}
+			toMigrate = append(toMigrate, legacyEntry{key: append([]byte{}, k...), entry: &entry})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, m := range toMigrate {
+			header, ciphertext, err := s.seal(m.entry, nil)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(m.key, ciphertext); err != nil {
+				return err
+			}
+			headerBts, err := json.Marshal(&header)
+			if err != nil {
+				return err
+			}
+			if err := headers.Put(m.key, headerBts); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *LogStore) seal(entry *LogEntry, credentialTypes []irma.CredentialTypeIdentifier) (LogHeader, []byte, error) {
+	header := LogHeader{Type: entry.Type, Time: entry.Time, Version: entry.Version, CredentialTypes: credentialTypes}
+
+	ciphertext, err := sealWith(s.aead, entry)
+	if err != nil {
+		return LogHeader{}, nil, err
+	}
+	return header, ciphertext, nil
+}
+
+func sealWith(aead cipher.AEAD, entry *LogEntry) ([]byte, error) {
+	plaintext, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (s *LogStore) open(ciphertext []byte) (*LogEntry, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errLogEntryCorrupted
+	}
+	nonce, sealed := ciphertext[:nonceSize], ciphertext[nonceSize:]
+
+	plaintext, err := s.aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.WrapPrefix(errLogEntryCorrupted, err.Error(), 0)
+	}
+
+	var entry LogEntry
+	if err := json.Unmarshal(plaintext, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
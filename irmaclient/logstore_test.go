@@ -0,0 +1,213 @@
+package irmaclient
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	bolt "go.etcd.io/bbolt"
+	"github.com/stretchr/testify/require"
+)
+
+func openTestLogDB(t *testing.T) *bolt.DB {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "logs.db"), 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func testLogEntry(action irma.Action, when time.Time) *LogEntry {
+	return &LogEntry{Type: action, Time: irma.Timestamp(when)}
+}
+
+func TestLogStoreRoundTrip(t *testing.T) {
+	db := openTestLogDB(t)
+	store, err := NewLogStore(db, []byte("test storage key"))
+	require.NoError(t, err)
+
+	entry := testLogEntry(irma.ActionDisclosing, time.Now())
+	require.NoError(t, store.Append(entry, nil))
+
+	// The body must actually be encrypted: it should not be recoverable by
+	// plain JSON-unmarshaling the stored bytes.
+	err = db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(logBucket).Cursor()
+		_, v := raw.First()
+		var leaked LogEntry
+		require.Error(t, json.Unmarshal(v, &leaked))
+		return nil
+	})
+	require.NoError(t, err)
+
+	found, err := store.Query(LogFilter{}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, entry.Type, found[0].Type)
+}
+
+func TestLogStoreQueryFilters(t *testing.T) {
+	db := openTestLogDB(t)
+	store, err := NewLogStore(db, []byte("test storage key"))
+	require.NoError(t, err)
+
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now()
+
+	require.NoError(t, store.Append(testLogEntry(irma.ActionDisclosing, old), nil))
+	require.NoError(t, store.Append(testLogEntry(irma.ActionIssuing, recent), nil))
+
+	disclosing := irma.ActionDisclosing
+	found, err := store.Query(LogFilter{Type: &disclosing}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, irma.ActionDisclosing, found[0].Type)
+
+	from := irma.Timestamp(time.Now().Add(-time.Hour))
+	found, err = store.Query(LogFilter{From: &from}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, irma.ActionIssuing, found[0].Type)
+}
+
+func TestLogStoreQueryPagination(t *testing.T) {
+	db := openTestLogDB(t)
+	store, err := NewLogStore(db, []byte("test storage key"))
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, store.Append(testLogEntry(irma.ActionSigning, time.Now()), nil))
+	}
+
+	page, err := store.Query(LogFilter{}, 0, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+
+	page, err = store.Query(LogFilter{}, 4, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+
+	page, err = store.Query(LogFilter{}, 10, 2)
+	require.NoError(t, err)
+	require.Len(t, page, 0)
+}
+
+func TestLogStoreQueryFiltersByCredentialType(t *testing.T) {
+	db := openTestLogDB(t)
+	store, err := NewLogStore(db, []byte("test storage key"))
+	require.NoError(t, err)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.ageLower")
+	passport := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+
+	require.NoError(t, store.Append(
+		testLogEntry(irma.ActionDisclosing, time.Now()),
+		[]irma.CredentialTypeIdentifier{studentCard}))
+	require.NoError(t, store.Append(
+		testLogEntry(irma.ActionDisclosing, time.Now()),
+		[]irma.CredentialTypeIdentifier{passport}))
+	require.NoError(t, store.Append(
+		testLogEntry(irma.ActionIssuing, time.Now()),
+		[]irma.CredentialTypeIdentifier{studentCard, passport}))
+
+	found, err := store.Query(LogFilter{CredentialType: &studentCard}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+
+	found, err = store.Query(LogFilter{CredentialType: &passport}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 2)
+
+	other := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.unrelated")
+	found, err = store.Query(LogFilter{CredentialType: &other}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 0)
+}
+
+func TestLogStoreKeyRotation(t *testing.T) {
+	db := openTestLogDB(t)
+	store, err := NewLogStore(db, []byte("old key"))
+	require.NoError(t, err)
+	require.NoError(t, store.Append(testLogEntry(irma.ActionDisclosing, time.Now()), nil))
+
+	require.NoError(t, store.Rotate([]byte("new key")))
+
+	found, err := store.Query(LogFilter{}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+
+	// Reopening with the pre-rotation key must no longer be able to decrypt.
+	staleStore, err := NewLogStore(db, []byte("old key"))
+	require.NoError(t, err)
+	_, err = staleStore.Query(LogFilter{}, 0, -1)
+	require.Error(t, err)
+}
+
+func TestLogStoreCorruptedCiphertext(t *testing.T) {
+	db := openTestLogDB(t)
+	store, err := NewLogStore(db, []byte("test storage key"))
+	require.NoError(t, err)
+	require.NoError(t, store.Append(testLogEntry(irma.ActionDisclosing, time.Now()), nil))
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logBucket)
+		k, v := bucket.Cursor().First()
+		return bucket.Put(k, v[:len(v)-1])
+	})
+	require.NoError(t, err)
+
+	_, err = store.Query(LogFilter{}, 0, -1)
+	require.Error(t, err)
+}
+
+func TestLogStoreTruncatedCiphertext(t *testing.T) {
+	db := openTestLogDB(t)
+	store, err := NewLogStore(db, []byte("test storage key"))
+	require.NoError(t, err)
+	require.NoError(t, store.Append(testLogEntry(irma.ActionDisclosing, time.Now()), nil))
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(logBucket)
+		k, _ := bucket.Cursor().First()
+		return bucket.Put(k, []byte{0x01, 0x02})
+	})
+	require.NoError(t, err)
+
+	_, err = store.Query(LogFilter{}, 0, -1)
+	require.Error(t, err)
+}
+
+func TestLogStoreMigratesPlaintextEntries(t *testing.T) {
+	db := openTestLogDB(t)
+
+	legacy := testLogEntry(irma.ActionIssuing, time.Now())
+	legacyBts, err := json.Marshal(legacy)
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(logBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(sequenceKey(1), legacyBts)
+	})
+	require.NoError(t, err)
+
+	store, err := NewLogStore(db, []byte("test storage key"))
+	require.NoError(t, err)
+
+	found, err := store.Query(LogFilter{}, 0, -1)
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, irma.ActionIssuing, found[0].Type)
+
+	// The migrated entry must now be stored encrypted, not as plaintext JSON.
+	err = db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(logBucket).Get(sequenceKey(1))
+		var leaked LogEntry
+		require.Error(t, json.Unmarshal(v, &leaked))
+		return nil
+	})
+	require.NoError(t, err)
+}
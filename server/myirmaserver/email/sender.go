@@ -0,0 +1,79 @@
+package email
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Sender dispatches outgoing login/verification e-mails, DKIM-signing each
+// message before handing it to the configured SMTP server.
+type Sender struct {
+	smtpServer string // host:port of the outgoing SMTP server
+	smtpFrom   string // envelope and From address used for outgoing mail
+	signer     Signer // may be nil if DKIM signing is not configured
+}
+
+// NewSender constructs a Sender that signs outgoing mail with signer before
+// relaying it through smtpServer. signer may be nil, in which case messages
+// are sent unsigned (e.g. when DKIM is not configured).
+func NewSender(smtpServer, smtpFrom string, signer Signer) *Sender {
+	return &Sender{smtpServer: smtpServer, smtpFrom: smtpFrom, signer: signer}
+}
+
+// Send builds a minimal RFC 5322 message with the given subject and body,
+// signs it (if a Signer was configured) and relays it to to. It rejects a
+// to or subject containing a CR or LF: both are interpolated directly into
+// the header block below, and smtp.SendMail only validates its own from/to
+// arguments, not these, so an unsanitized value could otherwise let a
+// caller inject arbitrary extra headers (e.g. a Bcc).
+func (s *Sender) Send(to, subject, body string) error {
+	if err := rejectCRLF("to", to); err != nil {
+		return err
+	}
+	if err := rejectCRLF("subject", subject); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMessage-ID: <%s>\r\n\r\n%s\r\n",
+		s.smtpFrom, to, subject, time.Now().UTC().Format(time.RFC1123Z), messageID(s.smtpFrom), body,
+	)
+
+	raw := []byte(message)
+	if s.signer != nil {
+		signed, err := s.signer.Sign(raw)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to DKIM-sign outgoing e-mail", 0)
+		}
+		raw = signed
+	}
+
+	return smtp.SendMail(s.smtpServer, nil, s.smtpFrom, []string{to}, raw)
+}
+
+// rejectCRLF returns an error naming field if value contains a CR or LF.
+func rejectCRLF(field, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.Errorf("e-mail %s must not contain a CR or LF", field)
+	}
+	return nil
+}
+
+// messageID generates a random Message-ID, qualified with the domain of
+// from (the part after the "@").
+func messageID(from string) string {
+	domain := "localhost"
+	if idx := strings.LastIndexByte(from, '@'); idx >= 0 {
+		domain = from[idx+1:]
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b) + "@" + domain
+}
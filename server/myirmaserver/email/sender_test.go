@@ -0,0 +1,20 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendRejectsHeaderInjection(t *testing.T) {
+	s := NewSender("smtp.example.com:25", "myirma@example.com", nil)
+
+	err := s.Send("user@example.com\r\nBcc: attacker@evil.com", "subject", "body")
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "to"))
+
+	err = s.Send("user@example.com", "subject\r\nBcc: attacker@evil.com", "body")
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "subject"))
+}
@@ -0,0 +1,347 @@
+package myirmaserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// memoryUser is a single user account in a myirmaMemoryDB.
+type memoryUser struct {
+	id       int64
+	username string
+	language string
+	lastSeen int64
+
+	deleted  bool  // true once RemoveUser has been called
+	deleteOn int64 // unix time after which a deleted user may be purged
+
+	emails map[string]*memoryEmail // keyed by e-mail address
+	logs   []LogEntry              // in chronological (ascending) order
+}
+
+// memoryEmail is a single e-mail address registered to a memoryUser.
+type memoryEmail struct {
+	deleteOn int64 // 0 means not scheduled for deletion
+}
+
+type memoryLoginToken struct {
+	email  string
+	expiry int64
+}
+
+type memoryVerificationToken struct {
+	userID int64
+	email  string
+	expiry int64
+}
+
+// myirmaMemoryDB is an in-memory MyirmaDB implementation, intended for unit
+// tests and small deployments that do not want to run a PostgreSQL instance.
+// It mirrors the expiry, rowcount and single-use semantics of
+// myirmaPostgresDB exactly, so the two can share a contract test suite.
+type myirmaMemoryDB struct {
+	lock sync.RWMutex
+
+	deleteDelay int
+	nextID      int64
+
+	users              map[int64]*memoryUser
+	loginTokens        map[string]*memoryLoginToken
+	verificationTokens map[string]*memoryVerificationToken
+
+	// loginAttempts holds, per e-mail address and per source IP, the unix
+	// timestamps of login attempts within the last emailLoginAttemptWindow.
+	// Older timestamps are pruned on access.
+	loginAttemptsByEmail map[string][]int64
+	loginAttemptsByIP    map[string][]int64
+}
+
+// NewMemoryDatabase constructs an empty, ready to use in-memory MyirmaDB.
+func NewMemoryDatabase(deleteDelay int) MyirmaDB {
+	return &myirmaMemoryDB{
+		deleteDelay:          deleteDelay,
+		users:                map[int64]*memoryUser{},
+		loginTokens:          map[string]*memoryLoginToken{},
+		verificationTokens:   map[string]*memoryVerificationToken{},
+		loginAttemptsByEmail: map[string][]int64{},
+		loginAttemptsByIP:    map[string][]int64{},
+	}
+}
+
+func (db *myirmaMemoryDB) deleteOnFromNow() int64 {
+	return time.Now().Add(time.Duration(24*db.deleteDelay) * time.Hour).Unix()
+}
+
+// findUserByUsername returns the user with the given username, or nil if no
+// such user exists. Caller must hold db.lock.
+func (db *myirmaMemoryDB) findUserByUsername(username string) *memoryUser {
+	for _, u := range db.users {
+		if u.username == username {
+			return u
+		}
+	}
+	return nil
+}
+
+// emailActive reports whether email is a currently active address of user:
+// either not scheduled for deletion, or scheduled but not yet past its
+// deletion time.
+func emailActive(email *memoryEmail, now int64) bool {
+	return email.deleteOn == 0 || email.deleteOn >= now
+}
+
+func (db *myirmaMemoryDB) GetUserID(username string) (int64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	user := db.findUserByUsername(username)
+	if user == nil {
+		return 0, ErrUserNotFound
+	}
+	return user.id, nil
+}
+
+func (db *myirmaMemoryDB) VerifyEmailToken(token string) (int64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := time.Now().Unix()
+	t, ok := db.verificationTokens[token]
+	if !ok || t.expiry < now {
+		return 0, ErrUserNotFound
+	}
+
+	if err := db.addEmailLocked(t.userID, t.email); err != nil {
+		return 0, err
+	}
+
+	delete(db.verificationTokens, token)
+	return t.userID, nil
+}
+
+func (db *myirmaMemoryDB) RemoveUser(id int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	user, ok := db.users[id]
+	if !ok || user.deleted {
+		return ErrUserNotFound
+	}
+	user.deleted = true
+	user.deleteOn = db.deleteOnFromNow()
+	return nil
+}
+
+// AddEmailLoginToken always returns nil, even for an e-mail address that is
+// not registered, and stores the token either way; the only step that
+// depends on whether the address is registered is a server-side log line.
+// This way neither this call's result nor its timing lets an attacker
+// enumerate which addresses are registered (see the postgres implementation
+// for why).
+func (db *myirmaMemoryDB) AddEmailLoginToken(email, token string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := time.Now().Unix()
+	found := false
+	for _, user := range db.users {
+		if e, ok := user.emails[email]; ok && emailActive(e, now) {
+			found = true
+			break
+		}
+	}
+
+	db.loginTokens[token] = &memoryLoginToken{
+		email:  email,
+		expiry: time.Now().Add(EMAIL_TOKEN_VALIDITY * time.Minute).Unix(),
+	}
+
+	if !found {
+		server.LogError(errors.Errorf("requested an e-mail login token for an unregistered address"))
+	}
+	return nil
+}
+
+// pruneAttempts drops timestamps older than emailLoginAttemptWindow from
+// attempts and returns the remaining, still-valid ones. Caller must hold
+// db.lock for writing.
+func pruneAttempts(attempts []int64, now int64) []int64 {
+	windowStart := now - int64(emailLoginAttemptWindow/time.Second)
+	kept := attempts[:0]
+	for _, t := range attempts {
+		if t >= windowStart {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// RegisterEmailLoginAttempt implements MyirmaDB.
+func (db *myirmaMemoryDB) RegisterEmailLoginAttempt(email, remoteIP string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := time.Now().Unix()
+	emailAttempts := pruneAttempts(db.loginAttemptsByEmail[email], now)
+	ipAttempts := pruneAttempts(db.loginAttemptsByIP[remoteIP], now)
+
+	if len(emailAttempts) >= emailLoginAttemptsPerEmail || len(ipAttempts) >= emailLoginAttemptsPerIP {
+		db.loginAttemptsByEmail[email] = emailAttempts
+		db.loginAttemptsByIP[remoteIP] = ipAttempts
+		return ErrTooManyRequests
+	}
+
+	db.loginAttemptsByEmail[email] = append(emailAttempts, now)
+	db.loginAttemptsByIP[remoteIP] = append(ipAttempts, now)
+	return nil
+}
+
+func (db *myirmaMemoryDB) LoginTokenGetCandidates(token string) ([]LoginCandidate, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	now := time.Now().Unix()
+	t, ok := db.loginTokens[token]
+	if !ok || t.expiry < now {
+		return nil, ErrUserNotFound
+	}
+
+	candidates := []LoginCandidate{}
+	for _, user := range db.users {
+		if e, ok := user.emails[t.email]; ok && emailActive(e, now) {
+			candidates = append(candidates, LoginCandidate{Username: user.username, LastActive: user.lastSeen})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return candidates, nil
+}
+
+func (db *myirmaMemoryDB) LoginTokenGetEmail(token string) (string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	t, ok := db.loginTokens[token]
+	if !ok || t.expiry < time.Now().Unix() {
+		return "", ErrUserNotFound
+	}
+	return t.email, nil
+}
+
+func (db *myirmaMemoryDB) TryUserLoginToken(token, username string) (bool, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := time.Now().Unix()
+	t, ok := db.loginTokens[token]
+	// As in the postgres implementation, the token is deleted whether or not
+	// the lookup below succeeds. This happens under the same lock that checks
+	// its validity, so (unlike the postgres implementation, which relies on
+	// the DELETE rowcount to detect a racing consumer) it can never be used
+	// twice.
+	delete(db.loginTokens, token)
+	if !ok || t.expiry < now {
+		return false, ErrUserNotFound
+	}
+
+	user := db.findUserByUsername(username)
+	if user == nil {
+		return false, ErrUserNotFound
+	}
+	if e, ok := user.emails[t.email]; !ok || !emailActive(e, now) {
+		return false, ErrUserNotFound
+	}
+	return true, nil
+}
+
+func (db *myirmaMemoryDB) addEmailLocked(id int64, email string) error {
+	user, ok := db.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if e, ok := user.emails[email]; ok {
+		e.deleteOn = 0
+		return nil
+	}
+	user.emails[email] = &memoryEmail{}
+	return nil
+}
+
+func (db *myirmaMemoryDB) AddEmail(id int64, email string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.addEmailLocked(id, email)
+}
+
+func (db *myirmaMemoryDB) RemoveEmail(id int64, email string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	e, ok := user.emails[email]
+	if !ok || e.deleteOn != 0 {
+		return ErrUserNotFound
+	}
+	e.deleteOn = db.deleteOnFromNow()
+	return nil
+}
+
+func (db *myirmaMemoryDB) SetSeen(id int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.lastSeen = time.Now().Unix()
+	return nil
+}
+
+func (db *myirmaMemoryDB) GetUserInformation(id int64) (UserInformation, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return UserInformation{}, ErrUserNotFound
+	}
+
+	now := time.Now().Unix()
+	result := UserInformation{
+		Username:         user.username,
+		language:         user.language,
+		DeleteInProgress: user.deleted,
+	}
+	for email, e := range user.emails {
+		if !emailActive(e, now) {
+			continue
+		}
+		result.Emails = append(result.Emails, UserEmail{Email: email, DeleteInProgress: e.deleteOn != 0})
+	}
+	return result, nil
+}
+
+func (db *myirmaMemoryDB) GetLogs(id int64, offset, ammount int) ([]LogEntry, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	user, ok := db.users[id]
+	if !ok {
+		return nil, nil
+	}
+
+	// logs are stored ascending; GetLogs returns them newest first.
+	var result []LogEntry
+	for i := len(user.logs) - 1 - offset; i >= 0 && len(result) < ammount; i-- {
+		result = append(result, user.logs[i])
+	}
+	return result, nil
+}
@@ -0,0 +1,96 @@
+package myirmaserver
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// ErrUserNotFound is returned by MyirmaDB methods when the given user,
+// e-mail address or token does not (or no longer) exist.
+var ErrUserNotFound = errors.New("Could not find specified user")
+
+// ErrTooManyRequests is returned by RegisterEmailLoginAttempt when the
+// e-mail address or source IP passed to it has exceeded its rate limit.
+var ErrTooManyRequests = errors.New("Too many login attempts")
+
+// LoginCandidate is a username that a login token could apply to, along with
+// when that user was last active, so the frontend can ask the user to pick
+// the right account when an e-mail address is shared between users.
+type LoginCandidate struct {
+	Username   string `json:"username"`
+	LastActive int64  `json:"last_active"`
+}
+
+// UserEmail is an e-mail address registered to a user.
+type UserEmail struct {
+	Email            string `json:"email"`
+	DeleteInProgress bool   `json:"delete_in_progress"`
+}
+
+// UserInformation is the account information shown to a logged-in user.
+type UserInformation struct {
+	Username         string `json:"username"`
+	language         string
+	Emails           []UserEmail `json:"emails"`
+	DeleteInProgress bool        `json:"delete_in_progress"`
+}
+
+// LogEntry is a single past event for a user, as returned by GetLogs.
+type LogEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Event     string `json:"event"`
+	Param     string `json:"param,omitempty"`
+}
+
+// MyirmaDB abstracts the storage backend of the myirma server: user
+// accounts, their e-mail addresses, outstanding login/verification tokens
+// and the log of past events. Implementations must be safe for concurrent
+// use. See myirmaPostgresDB for the production backend and myirmaMemoryDB
+// for an in-memory backend suitable for tests and small deployments.
+type MyirmaDB interface {
+	GetUserID(username string) (int64, error)
+	VerifyEmailToken(token string) (int64, error)
+	RemoveUser(id int64) error
+
+	// RegisterEmailLoginAttempt rate-limits e-mail login token requests; it
+	// should be called once per incoming request, before AddEmailLoginToken.
+	RegisterEmailLoginAttempt(email, remoteIP string) error
+
+	// AddEmailLoginToken never returns ErrUserNotFound, even when email is
+	// not registered, so that callers cannot use it to enumerate registered
+	// addresses; an unregistered address simply never receives the e-mail.
+	AddEmailLoginToken(email, token string) error
+	LoginTokenGetCandidates(token string) ([]LoginCandidate, error)
+	LoginTokenGetEmail(token string) (string, error)
+	TryUserLoginToken(token, username string) (bool, error)
+
+	AddEmail(id int64, email string) error
+	RemoveEmail(id int64, email string) error
+
+	SetSeen(id int64) error
+	GetUserInformation(id int64) (UserInformation, error)
+	GetLogs(id int64, offset, ammount int) ([]LogEntry, error)
+}
+
+// DBType selects which MyirmaDB backend NewMyirmaDB constructs.
+type DBType string
+
+// DBTypes
+const (
+	DBTypePostgres = DBType("postgres")
+	DBTypeMemory   = DBType("memory")
+)
+
+// NewMyirmaDB constructs the MyirmaDB backend selected by dbType. connstring
+// is only used for DBTypePostgres; deleteDelay is the number of days a user
+// or e-mail address lingers after removal before being purged, for both
+// backends.
+func NewMyirmaDB(dbType DBType, connstring string, deleteDelay int) (MyirmaDB, error) {
+	switch dbType {
+	case DBTypePostgres:
+		return NewPostgresDatabase(connstring, deleteDelay)
+	case DBTypeMemory:
+		return NewMemoryDatabase(deleteDelay), nil
+	default:
+		return nil, errors.Errorf("unknown db_type %q", dbType)
+	}
+}
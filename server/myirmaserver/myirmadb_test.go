@@ -0,0 +1,157 @@
+package myirmaserver
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// myirmaDBTestBackend bundles a MyirmaDB under test together with a way to
+// seed it with a user account, so the same contract tests below can run
+// against both myirmaMemoryDB and myirmaPostgresDB.
+type myirmaDBTestBackend struct {
+	db       MyirmaDB
+	seedUser func(t *testing.T, username string) int64
+}
+
+func memoryBackend(t *testing.T) myirmaDBTestBackend {
+	db := NewMemoryDatabase(30).(*myirmaMemoryDB)
+	return myirmaDBTestBackend{
+		db: db,
+		seedUser: func(t *testing.T, username string) int64 {
+			db.lock.Lock()
+			defer db.lock.Unlock()
+			db.nextID++
+			id := db.nextID
+			db.users[id] = &memoryUser{id: id, username: username, emails: map[string]*memoryEmail{}}
+			return id
+		},
+	}
+}
+
+// postgresBackend is only exercised when IRMA_TEST_POSTGRES_CONNSTRING points
+// at a disposable database with the myirma schema applied; this keeps CI
+// from needing a database container just to run the memory-backed tests.
+func postgresBackend(t *testing.T) myirmaDBTestBackend {
+	connstring := os.Getenv("IRMA_TEST_POSTGRES_CONNSTRING")
+	if connstring == "" {
+		t.Skip("IRMA_TEST_POSTGRES_CONNSTRING not set, skipping postgres-backed MyirmaDB tests")
+	}
+
+	db, err := NewPostgresDatabase(connstring, 30)
+	require.NoError(t, err)
+	pg := db.(*myirmaPostgresDB)
+
+	return myirmaDBTestBackend{
+		db: db,
+		seedUser: func(t *testing.T, username string) int64 {
+			_, err := pg.db.Exec(
+				"INSERT INTO irma.users (username, language, coredata, last_seen) VALUES ($1, 'en', 'x', $2)",
+				username, time.Now().Unix())
+			require.NoError(t, err)
+			id, err := pg.GetUserID(username)
+			require.NoError(t, err)
+			return id
+		},
+	}
+}
+
+func runMyirmaDBContractTests(t *testing.T, backend func(t *testing.T) myirmaDBTestBackend) {
+	t.Run("GetUserID", func(t *testing.T) {
+		b := backend(t)
+		id := b.seedUser(t, "testuser")
+
+		got, err := b.db.GetUserID("testuser")
+		require.NoError(t, err)
+		require.Equal(t, id, got)
+
+		_, err = b.db.GetUserID("nonexistent")
+		require.Equal(t, ErrUserNotFound, err)
+	})
+
+	t.Run("AddEmailLoginTokenNeverRevealsUnknownEmail", func(t *testing.T) {
+		b := backend(t)
+		require.NoError(t, b.db.AddEmailLoginToken("unknown@example.com", "tok"))
+
+		// The token is stored, but resolves to no login candidates, so the
+		// unknown address is never revealed back to the caller.
+		_, err := b.db.LoginTokenGetCandidates("tok")
+		require.Equal(t, ErrUserNotFound, err)
+	})
+
+	t.Run("EmailLoginTokenRoundTrip", func(t *testing.T) {
+		b := backend(t)
+		id := b.seedUser(t, "emailuser")
+		require.NoError(t, b.db.AddEmail(id, "user@example.com"))
+		require.NoError(t, b.db.AddEmailLoginToken("user@example.com", "logintok"))
+
+		email, err := b.db.LoginTokenGetEmail("logintok")
+		require.NoError(t, err)
+		require.Equal(t, "user@example.com", email)
+
+		candidates, err := b.db.LoginTokenGetCandidates("logintok")
+		require.NoError(t, err)
+		require.Len(t, candidates, 1)
+		require.Equal(t, "emailuser", candidates[0].Username)
+
+		ok, err := b.db.TryUserLoginToken("logintok", "emailuser")
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		// The token is single-use.
+		_, err = b.db.LoginTokenGetEmail("logintok")
+		require.Equal(t, ErrUserNotFound, err)
+	})
+
+	t.Run("RemoveUserRejectsSecondCall", func(t *testing.T) {
+		b := backend(t)
+		id := b.seedUser(t, "removeuser")
+		require.NoError(t, b.db.RemoveUser(id))
+		require.Equal(t, ErrUserNotFound, b.db.RemoveUser(id))
+	})
+
+	t.Run("RegisterEmailLoginAttemptRateLimitsPerEmail", func(t *testing.T) {
+		b := backend(t)
+		for i := 0; i < emailLoginAttemptsPerEmail; i++ {
+			require.NoError(t, b.db.RegisterEmailLoginAttempt("ratelimited@example.com", "203.0.113.1"))
+		}
+		require.Equal(t, ErrTooManyRequests, b.db.RegisterEmailLoginAttempt("ratelimited@example.com", "203.0.113.1"))
+		// A different e-mail address from the same IP is unaffected by the
+		// per-address bucket.
+		require.NoError(t, b.db.RegisterEmailLoginAttempt("other@example.com", "203.0.113.1"))
+	})
+
+	t.Run("RegisterEmailLoginAttemptRateLimitsPerIP", func(t *testing.T) {
+		b := backend(t)
+		for i := 0; i < emailLoginAttemptsPerIP; i++ {
+			require.NoError(t, b.db.RegisterEmailLoginAttempt(fmt.Sprintf("user%d@example.com", i), "203.0.113.9"))
+		}
+		require.Equal(t, ErrTooManyRequests, b.db.RegisterEmailLoginAttempt("onemore@example.com", "203.0.113.9"))
+		// A different IP is unaffected by the per-IP bucket.
+		require.NoError(t, b.db.RegisterEmailLoginAttempt("another@example.com", "203.0.113.10"))
+	})
+
+	t.Run("AddRemoveEmail", func(t *testing.T) {
+		b := backend(t)
+		id := b.seedUser(t, "emailuser2")
+		require.NoError(t, b.db.AddEmail(id, "a@example.com"))
+
+		info, err := b.db.GetUserInformation(id)
+		require.NoError(t, err)
+		require.Len(t, info.Emails, 1)
+
+		require.NoError(t, b.db.RemoveEmail(id, "a@example.com"))
+		require.Equal(t, ErrUserNotFound, b.db.RemoveEmail(id, "a@example.com"))
+	})
+}
+
+func TestMyirmaMemoryDB(t *testing.T) {
+	runMyirmaDBContractTests(t, memoryBackend)
+}
+
+func TestMyirmaPostgresDB(t *testing.T) {
+	runMyirmaDBContractTests(t, postgresBackend)
+}
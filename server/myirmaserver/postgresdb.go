@@ -2,7 +2,6 @@ package myirmaserver
 
 import (
 	"database/sql"
-	"fmt"
 	"time"
 
 	"github.com/go-errors/errors"
@@ -17,6 +16,29 @@ type myirmaPostgresDB struct {
 
 const EMAIL_TOKEN_VALIDITY = 60 // Ammount of time an email login token is valid (in minutes)
 
+// Token bucket thresholds for RegisterEmailLoginAttempt: how many login
+// attempts a single e-mail address, respectively a single source IP, may
+// trigger within emailLoginAttemptWindow before further attempts are
+// rejected with ErrTooManyRequests.
+const (
+	emailLoginAttemptsPerEmail = 3
+	emailLoginAttemptsPerIP    = 30
+	emailLoginAttemptWindow    = time.Hour
+)
+
+// emailLookupMinDuration is a floor on the wall-clock time of
+// AddEmailLoginToken, VerifyEmailToken and TryUserLoginToken, so that a
+// failed lookup (e-mail/token unknown) cannot be distinguished from a
+// successful one by timing the response.
+const emailLookupMinDuration = 50 * time.Millisecond
+
+// padDuration sleeps until min has elapsed since start, if it hasn't already.
+func padDuration(start time.Time, min time.Duration) {
+	if remaining := min - time.Since(start); remaining > 0 {
+		time.Sleep(remaining)
+	}
+}
+
 func NewPostgresDatabase(connstring string, deleteDelay int) (MyirmaDB, error) {
 	db, err := sql.Open("pgx", connstring)
 	if err != nil {
@@ -43,30 +65,50 @@ func (db *myirmaPostgresDB) GetUserID(username string) (int64, error) {
 }
 
 func (db *myirmaPostgresDB) VerifyEmailToken(token string) (int64, error) {
+	defer padDuration(time.Now(), emailLookupMinDuration)
+
 	res, err := db.db.Query("SELECT user_id, email FROM irma.email_verification_tokens WHERE token = $1 AND expiry >= $2", token, time.Now().Unix())
 	if err != nil {
 		return 0, err
 	}
-	defer res.Close()
-	if !res.Next() {
-		return 0, ErrUserNotFound
-	}
+	found := res.Next()
 	var email string
 	var id int64
-	err = res.Scan(&id, &email)
+	if found {
+		err = res.Scan(&id, &email)
+	}
+	res.Close()
 	if err != nil {
 		return 0, err
 	}
 
-	err = db.AddEmail(id, email)
-	if err != nil {
-		return 0, err
+	// Run the same AddEmail call and DELETE statement regardless of whether
+	// the token above resolved to a real record, so an unknown/expired
+	// token takes the same code path -- and takes the same time -- as a
+	// valid one. For an unknown token there is no real (id, email) to reuse
+	// here, so we substitute the sentinel user id 0 (irma.users ids start
+	// at 1, so this can never collide with a real user) and the token
+	// itself as a placeholder e-mail address; AddEmail's UPDATE then never
+	// matches, and its fallback INSERT is rejected by the emails table's
+	// user_id foreign key, so this is a no-op beyond the one failed query.
+	lookupID, lookupEmail := id, email
+	if !found {
+		lookupID, lookupEmail = 0, token
+	}
+	addErr := db.AddEmail(lookupID, lookupEmail)
+	delres, delErr := db.db.Exec("DELETE FROM irma.email_verification_tokens WHERE token = $1", token)
+
+	if !found {
+		return 0, ErrUserNotFound
 	}
 
 	// Beyond this point, errors are no longer relevant for frontend, so only log
-	delres, err := db.db.Exec("DELETE FROM irma.email_verification_tokens WHERE token = $1", token)
-	if err != nil {
-		server.LogError(err)
+	if addErr != nil {
+		server.LogError(addErr)
+		return id, nil
+	}
+	if delErr != nil {
+		server.LogError(delErr)
 		return id, nil
 	}
 	aff, err := delres.RowsAffected()
@@ -98,24 +140,28 @@ func (db *myirmaPostgresDB) RemoveUser(id int64) error {
 	return nil
 }
 
+// AddEmailLoginToken always returns nil, even for an e-mail address that is
+// not registered (it simply never gets an e-mail for a token resolving to no
+// candidates downstream). What is returned does not depend on whether the
+// address exists, the token insert is always performed, and the only step
+// that does depend on it is a server-side log line after the insert, so
+// that neither this call's result nor its timing lets an attacker enumerate
+// which addresses are registered.
 func (db *myirmaPostgresDB) AddEmailLoginToken(email, token string) error {
-	// Check if email address exists in database
+	defer padDuration(time.Now(), emailLookupMinDuration)
+
 	eres, err := db.db.Query("SELECT 1 FROM irma.emails WHERE email = $1 AND (delete_on >= $2 OR delete_on IS NULL) LIMIT 1",
 		email, time.Now().Unix())
 	if err != nil {
 		return err
 	}
-	defer eres.Close()
-	if !eres.Next() {
-		return ErrUserNotFound
-	}
+	exists := eres.Next()
+	eres.Close()
 
-	// insert and verify
 	res, err := db.db.Exec("INSERT INTO irma.email_login_tokens (token, email, expiry) VALUES ($1, $2, $3)",
 		token,
 		email,
 		time.Now().Add(EMAIL_TOKEN_VALIDITY*time.Minute).Unix())
-	fmt.Println(time.Now().Add(EMAIL_TOKEN_VALIDITY*time.Minute).Unix(), " ", time.Now().Unix())
 	if err != nil {
 		return err
 	}
@@ -127,9 +173,60 @@ func (db *myirmaPostgresDB) AddEmailLoginToken(email, token string) error {
 		return errors.Errorf("Unexpected number of affected rows %d on token insert", aff)
 	}
 
+	if !exists {
+		server.LogError(errors.Errorf("requested an e-mail login token for an unregistered address"))
+	}
 	return nil
 }
 
+// RegisterEmailLoginAttempt records a login token request from remoteIP for
+// email, and rejects it with ErrTooManyRequests if either the address or the
+// source IP has exceeded its token bucket within emailLoginAttemptWindow.
+// Callers should invoke this before AddEmailLoginToken.
+//
+// The count-then-insert below runs inside a transaction that first takes
+// postgres advisory locks keyed on email and remoteIP, so that two
+// concurrent attempts for the same address or IP are serialized instead of
+// both reading a count below the threshold and both being let through.
+func (db *myirmaPostgresDB) RegisterEmailLoginAttempt(email, remoteIP string) error {
+	windowStart := time.Now().Add(-emailLoginAttemptWindow).Unix()
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('email:' || $1)::bigint)", email); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('ip:' || $1)::bigint)", remoteIP); err != nil {
+		return err
+	}
+
+	var emailCount int
+	if err := tx.QueryRow("SELECT count(*) FROM irma.email_login_attempts WHERE email = $1 AND time >= $2",
+		email, windowStart).Scan(&emailCount); err != nil {
+		return err
+	}
+	var ipCount int
+	if err := tx.QueryRow("SELECT count(*) FROM irma.email_login_attempts WHERE remote_ip = $1 AND time >= $2",
+		remoteIP, windowStart).Scan(&ipCount); err != nil {
+		return err
+	}
+
+	if emailCount >= emailLoginAttemptsPerEmail || ipCount >= emailLoginAttemptsPerIP {
+		return ErrTooManyRequests
+	}
+
+	if _, err := tx.Exec("INSERT INTO irma.email_login_attempts (email, remote_ip, time) VALUES ($1, $2, $3)",
+		email, remoteIP, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (db *myirmaPostgresDB) LoginTokenGetCandidates(token string) ([]LoginCandidate, error) {
 	res, err := db.db.Query(`SELECT username, last_seen FROM irma.users WHERE id IN
 							     (SELECT user_id FROM irma.emails WHERE (delete_on >= $2 OR delete_on is NULL) AND
@@ -169,6 +266,8 @@ func (db *myirmaPostgresDB) LoginTokenGetEmail(token string) (string, error) {
 }
 
 func (db *myirmaPostgresDB) TryUserLoginToken(token, username string) (bool, error) {
+	defer padDuration(time.Now(), emailLookupMinDuration)
+
 	res, err := db.db.Query(`SELECT 1 FROM irma.users INNER JOIN irma.emails ON users.id = emails.user_id WHERE
 								 username = $1 AND (emails.delete_on >= $3 OR emails.delete_on IS NULL) AND
 								 email = (SELECT email FROM irma.email_login_tokens WHERE token = $2 AND expiry >= $3)`,
@@ -176,12 +275,13 @@ func (db *myirmaPostgresDB) TryUserLoginToken(token, username string) (bool, err
 	if err != nil {
 		return false, err
 	}
-	defer res.Close()
-	if !res.Next() {
-		return false, ErrUserNotFound
-	}
+	found := res.Next()
+	res.Close()
 
-	// Successfull deletion of the token can only occur once, so we use that to signal ok to login
+	// Always attempt the delete, whether or not the lookup above matched,
+	// so an unknown token/username combination takes the same code path --
+	// and takes the same time -- as a valid one; deleting a token that
+	// doesn't exist is a harmless no-op (aff will simply be 0).
 	delres, err := db.db.Exec("DELETE FROM irma.email_login_tokens WHERE token = $1", token)
 	if err != nil {
 		return false, err
@@ -190,6 +290,11 @@ func (db *myirmaPostgresDB) TryUserLoginToken(token, username string) (bool, err
 	if err != nil {
 		return false, err
 	}
+
+	if !found {
+		return false, ErrUserNotFound
+	}
+	// Successfull deletion of the token can only occur once, so we use that to signal ok to login
 	if aff != 1 {
 		return false, nil
 	}